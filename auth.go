@@ -0,0 +1,152 @@
+package koushin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	imapclient "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"golang.org/x/oauth2"
+)
+
+// Authenticator abstracts how a session authenticates to IMAP and SMTP, so
+// that app passwords and OAuth2 tokens flow through the same code paths in
+// handleLogin and handleCompose instead of a cleartext password stored on
+// the session.
+type Authenticator interface {
+	// Username is the account's login name.
+	Username() string
+
+	// AuthenticateIMAP logs conn into the IMAP server.
+	AuthenticateIMAP(conn *imapclient.Client) error
+
+	// SMTPClient returns the SASL client used to authenticate an outgoing
+	// SMTP connection.
+	SMTPClient() (sasl.Client, error)
+}
+
+// LoginAuthenticator authenticates with the IMAP LOGIN command and SASL
+// PLAIN over SMTP, using a cleartext or app password.
+type LoginAuthenticator struct {
+	username string
+	password string
+}
+
+func NewLoginAuthenticator(username, password string) *LoginAuthenticator {
+	return &LoginAuthenticator{username: username, password: password}
+}
+
+func (a *LoginAuthenticator) Username() string { return a.username }
+
+func (a *LoginAuthenticator) AuthenticateIMAP(conn *imapclient.Client) error {
+	return conn.Login(a.username, a.password)
+}
+
+func (a *LoginAuthenticator) SMTPClient() (sasl.Client, error) {
+	return sasl.NewPlainClient("", a.username, a.password), nil
+}
+
+// PlainAuthenticator authenticates with SASL PLAIN over IMAP, for servers
+// that don't support (or have disabled) the IMAP LOGIN command.
+type PlainAuthenticator struct {
+	username string
+	password string
+}
+
+func NewPlainAuthenticator(username, password string) *PlainAuthenticator {
+	return &PlainAuthenticator{username: username, password: password}
+}
+
+func (a *PlainAuthenticator) Username() string { return a.username }
+
+func (a *PlainAuthenticator) AuthenticateIMAP(conn *imapclient.Client) error {
+	return conn.Authenticate(sasl.NewPlainClient("", a.username, a.password))
+}
+
+func (a *PlainAuthenticator) SMTPClient() (sasl.Client, error) {
+	return sasl.NewPlainClient("", a.username, a.password), nil
+}
+
+// OAuthProvider configures an OAuth2 authorization-code flow used to
+// obtain and refresh XOAUTH2 tokens for an account.
+type OAuthProvider struct {
+	Name   string
+	Config *oauth2.Config
+}
+
+// OAuthAuthenticator authenticates with XOAUTH2 over IMAP and OAUTHBEARER
+// over SMTP, transparently refreshing the underlying token as it approaches
+// expiry.
+type OAuthAuthenticator struct {
+	username string
+	provider *OAuthProvider
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func NewOAuthAuthenticator(username string, provider *OAuthProvider, token *oauth2.Token) *OAuthAuthenticator {
+	return &OAuthAuthenticator{username: username, provider: provider, token: token}
+}
+
+func (a *OAuthAuthenticator) Username() string { return a.username }
+
+func (a *OAuthAuthenticator) accessToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token.Valid() {
+		return a.token.AccessToken, nil
+	}
+
+	tok, err := a.provider.Config.TokenSource(context.Background(), a.token).Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh OAuth2 token: %v", err)
+	}
+	a.token = tok
+	return tok.AccessToken, nil
+}
+
+// refreshIfExpiringSoon proactively refreshes the token if it expires
+// within window, rather than waiting for it to actually go invalid:
+// oauth2.Token.Valid only affords a ~10s grace period, which isn't enough
+// lead time for a background refresh to mean anything.
+func (a *OAuthAuthenticator) refreshIfExpiringSoon(window time.Duration) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token.Expiry.IsZero() || time.Until(a.token.Expiry) > window {
+		return nil
+	}
+
+	// TokenSource hands back a token as-is while it's still valid, so only
+	// pass it the refresh token to force an actual refresh.
+	stale := &oauth2.Token{RefreshToken: a.token.RefreshToken}
+	tok, err := a.provider.Config.TokenSource(context.Background(), stale).Token()
+	if err != nil {
+		return fmt.Errorf("failed to refresh OAuth2 token: %v", err)
+	}
+	a.token = tok
+	return nil
+}
+
+func (a *OAuthAuthenticator) AuthenticateIMAP(conn *imapclient.Client) error {
+	token, err := a.accessToken()
+	if err != nil {
+		return err
+	}
+	return conn.Authenticate(sasl.NewXoauth2Client(a.username, token))
+}
+
+func (a *OAuthAuthenticator) SMTPClient() (sasl.Client, error) {
+	token, err := a.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+		Username: a.username,
+		Token:    token,
+	}), nil
+}
@@ -0,0 +1,233 @@
+package koushin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+)
+
+// defaultSentMailboxName is used when the IMAP server doesn't advertise a
+// \Sent special-use mailbox and the administrator hasn't configured one.
+const defaultSentMailboxName = "Sent"
+
+// OutgoingMessage is a message to be delivered over SMTP and, on success,
+// appended to the user's Sent mailbox.
+type OutgoingMessage struct {
+	From        string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	InReplyTo   string
+	References  []string
+	Text        string
+	Attachments []*multipart.FileHeader
+}
+
+// parseAddressList parses a comma-separated address list as found in a form
+// field, e.g. the contents of the "to" or "cc" inputs on the compose form.
+func parseAddressList(s string) ([]*mail.Address, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	addrs, err := mail.ParseAddressList(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse address list %q: %v", s, err)
+	}
+	return addrs, nil
+}
+
+func toGoMailAddresses(addrs []*mail.Address) []*gomail.Address {
+	l := make([]*gomail.Address, len(addrs))
+	for i, a := range addrs {
+		l[i] = &gomail.Address{Name: a.Name, Address: a.Address}
+	}
+	return l
+}
+
+// build serializes msg into a RFC 5322 message and returns the raw bytes
+// alongside the list of SMTP envelope recipients (To, Cc and Bcc).
+func (msg *OutgoingMessage) build() ([]byte, []string, error) {
+	from, err := parseAddressList(msg.From)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := parseAddressList(strings.Join(msg.To, ", "))
+	if err != nil {
+		return nil, nil, err
+	}
+	cc, err := parseAddressList(strings.Join(msg.Cc, ", "))
+	if err != nil {
+		return nil, nil, err
+	}
+	bcc, err := parseAddressList(strings.Join(msg.Bcc, ", "))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rcpts []string
+	for _, a := range append(append(append([]*mail.Address{}, to...), cc...), bcc...) {
+		rcpts = append(rcpts, a.Address)
+	}
+
+	var h gomail.Header
+	h.SetAddressList("From", toGoMailAddresses(from))
+	h.SetAddressList("To", toGoMailAddresses(to))
+	if len(cc) > 0 {
+		h.SetAddressList("Cc", toGoMailAddresses(cc))
+	}
+	// Bcc recipients are only used for the envelope, never written to the
+	// message headers.
+	h.SetSubject(msg.Subject)
+	h.SetDate(time.Now())
+	if msg.InReplyTo != "" {
+		h.SetMsgIDList("In-Reply-To", []string{msg.InReplyTo})
+	}
+	if len(msg.References) > 0 {
+		h.SetMsgIDList("References", msg.References)
+	}
+
+	var b bytes.Buffer
+	mw, err := gomail.CreateWriter(&b, h)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create message writer: %v", err)
+	}
+
+	tw, err := mw.CreateInline()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create inline writer: %v", err)
+	}
+	w, err := tw.CreatePart(gomail.InlineHeader{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create text part: %v", err)
+	}
+	if _, err := w.Write([]byte(msg.Text)); err != nil {
+		return nil, nil, fmt.Errorf("failed to write text part: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, att := range msg.Attachments {
+		f, err := att.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open attachment %q: %v", att.Filename, err)
+		}
+
+		var ah gomail.AttachmentHeader
+		ah.Set("Content-Type", att.Header.Get("Content-Type"))
+		ah.SetFilename(att.Filename)
+
+		aw, err := mw.CreateAttachment(ah)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to create attachment part: %v", err)
+		}
+		if _, err := io.Copy(aw, f); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to write attachment %q: %v", att.Filename, err)
+		}
+		f.Close()
+		if err := aw.Close(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to finalize message: %v", err)
+	}
+
+	return b.Bytes(), rcpts, nil
+}
+
+// sendMessage delivers msg over the SMTP connection c and returns the raw
+// RFC 5322 bytes that were sent, so that the caller can append them to the
+// user's Sent mailbox.
+func sendMessage(c *smtp.Client, msg *OutgoingMessage) ([]byte, error) {
+	raw, rcpts, err := msg.build()
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := parseAddressList(msg.From)
+	if err != nil {
+		return nil, err
+	}
+	if len(from) != 1 {
+		return nil, fmt.Errorf("expected exactly one From address, got %d", len(from))
+	}
+
+	if err := c.Mail(from[0].Address, nil); err != nil {
+		return nil, fmt.Errorf("MAIL FROM failed: %v", err)
+	}
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			return nil, fmt.Errorf("RCPT TO <%s> failed: %v", rcpt, err)
+		}
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return nil, fmt.Errorf("DATA failed: %v", err)
+	}
+	if _, err := wc.Write(raw); err != nil {
+		wc.Close()
+		return nil, fmt.Errorf("failed to write message body: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize message body: %v", err)
+	}
+
+	return raw, nil
+}
+
+// findSentMailbox auto-detects the user's Sent mailbox via the IMAP
+// SPECIAL-USE \Sent attribute, falling back to fallbackName if the server
+// doesn't advertise one.
+func findSentMailbox(conn *imapclient.Client, fallbackName string) (string, error) {
+	if fallbackName == "" {
+		fallbackName = defaultSentMailboxName
+	}
+
+	ch := make(chan *imap.MailboxInfo, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.List("", "*", ch)
+	}()
+
+	var sent string
+	for mbox := range ch {
+		for _, attr := range mbox.Attributes {
+			if attr == imap.SentAttr {
+				sent = mbox.Name
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return "", fmt.Errorf("failed to list mailboxes: %v", err)
+	}
+
+	if sent == "" {
+		sent = fallbackName
+	}
+	return sent, nil
+}
+
+// appendToSent appends the raw RFC 5322 message to the named mailbox with
+// the \Seen flag and the current time as the internal date.
+func appendToSent(conn *imapclient.Client, mailbox string, raw []byte) error {
+	flags := []string{imap.SeenFlag}
+	return conn.Append(mailbox, flags, time.Now(), bytes.NewReader(raw))
+}
@@ -0,0 +1,93 @@
+package koushin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAddressList(t *testing.T) {
+	addrs, err := parseAddressList("Alice <alice@example.com>, bob@example.com")
+	if err != nil {
+		t.Fatalf("parseAddressList() error = %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("len(addrs) = %d, want 2", len(addrs))
+	}
+	if addrs[0].Name != "Alice" || addrs[0].Address != "alice@example.com" {
+		t.Errorf("addrs[0] = %+v, want Alice <alice@example.com>", addrs[0])
+	}
+	if addrs[1].Address != "bob@example.com" {
+		t.Errorf("addrs[1] = %+v, want bob@example.com", addrs[1])
+	}
+}
+
+func TestParseAddressListEmpty(t *testing.T) {
+	addrs, err := parseAddressList("   ")
+	if err != nil {
+		t.Fatalf("parseAddressList() error = %v", err)
+	}
+	if addrs != nil {
+		t.Errorf("addrs = %v, want nil", addrs)
+	}
+}
+
+func TestParseAddressListInvalid(t *testing.T) {
+	if _, err := parseAddressList("not an address"); err == nil {
+		t.Fatal("parseAddressList() with an invalid address should error")
+	}
+}
+
+func TestOutgoingMessageBuildRecipients(t *testing.T) {
+	msg := &OutgoingMessage{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.com"},
+		Cc:      []string{"carol@example.com"},
+		Bcc:     []string{"dave@example.com"},
+		Subject: "Hello",
+		Text:    "hi there",
+	}
+
+	raw, rcpts, err := msg.build()
+	if err != nil {
+		t.Fatalf("build() error = %v", err)
+	}
+
+	wantRcpts := map[string]bool{
+		"bob@example.com":   true,
+		"carol@example.com": true,
+		"dave@example.com":  true,
+	}
+	if len(rcpts) != len(wantRcpts) {
+		t.Fatalf("rcpts = %v, want %v", rcpts, wantRcpts)
+	}
+	for _, r := range rcpts {
+		if !wantRcpts[r] {
+			t.Errorf("unexpected recipient %q", r)
+		}
+	}
+
+	// Bcc must never appear in the serialized headers, only in the SMTP
+	// envelope recipients above.
+	if strings.Contains(string(raw), "dave@example.com") {
+		t.Error("Bcc address leaked into the serialized message headers")
+	}
+	if !strings.Contains(string(raw), "carol@example.com") {
+		t.Error("Cc address missing from the serialized message headers")
+	}
+}
+
+func TestOutgoingMessageBuildNoAttachments(t *testing.T) {
+	msg := &OutgoingMessage{
+		From: "alice@example.com",
+		To:   []string{"bob@example.com"},
+		Text: "hi",
+	}
+
+	raw, _, err := msg.build()
+	if err != nil {
+		t.Fatalf("build() error = %v", err)
+	}
+	if len(raw) == 0 {
+		t.Error("build() returned an empty message")
+	}
+}
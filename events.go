@@ -0,0 +1,72 @@
+package koushin
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// handleEvents streams mailbox change notifications (as reported by the
+// session's background IDLE loop) to the browser over Server-Sent Events.
+func handleEvents(ectx echo.Context) error {
+	ctx := ectx.(*context)
+
+	res := ctx.Response()
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+
+	sub := ctx.session.broadcast.subscribe()
+	defer ctx.session.broadcast.unsubscribe(sub)
+
+	done := ctx.Request().Context().Done()
+	for {
+		select {
+		case <-sub:
+			fmt.Fprint(res, "event: update\ndata: {}\n\n")
+			res.Flush()
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// broadcaster fans out a "something changed" signal to any number of
+// subscribers, without blocking the publisher if a subscriber isn't ready
+// to receive (the signal just carries no payload, so coalescing is fine).
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: make(map[chan struct{}]struct{})}
+}
+
+func (b *broadcaster) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *broadcaster) publish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A notification is already pending for this subscriber.
+		}
+	}
+}
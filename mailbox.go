@@ -0,0 +1,112 @@
+package koushin
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// messagesPerPage is the number of messages shown on a single mailbox page.
+const messagesPerPage = 50
+
+var mailboxFetchItems = []imap.FetchItem{
+	imap.FetchEnvelope,
+	imap.FetchFlags,
+	imap.FetchInternalDate,
+	imap.FetchUid,
+}
+
+func listMailboxes(conn *imapclient.Client) ([]*imap.MailboxInfo, error) {
+	ch := make(chan *imap.MailboxInfo, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.List("", "*", ch)
+	}()
+
+	var mailboxes []*imap.MailboxInfo
+	for mbox := range ch {
+		mailboxes = append(mailboxes, mbox)
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to list mailboxes: %v", err)
+	}
+
+	return mailboxes, nil
+}
+
+// listMessages fetches the messages of mboxName whose UID is in uids, newest
+// first. If uids is nil, the most recent messagesPerPage messages in the
+// mailbox are fetched instead.
+func listMessages(conn *imapclient.Client, mboxName string, uids *imap.SeqSet) ([]*imap.Message, error) {
+	mbox, err := conn.Select(mboxName, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select mailbox: %v", err)
+	}
+
+	if uids != nil {
+		return fetchMessages(conn, uids, true)
+	}
+
+	if mbox.Messages == 0 {
+		return nil, nil
+	}
+
+	from := uint32(1)
+	if mbox.Messages > messagesPerPage {
+		from = mbox.Messages - messagesPerPage + 1
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(from, mbox.Messages)
+
+	return fetchMessages(conn, seqSet, false)
+}
+
+func fetchMessages(conn *imapclient.Client, set *imap.SeqSet, byUid bool) ([]*imap.Message, error) {
+	ch := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		if byUid {
+			done <- conn.UidFetch(set, mailboxFetchItems, ch)
+		} else {
+			done <- conn.Fetch(set, mailboxFetchItems, ch)
+		}
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch messages: %v", err)
+	}
+
+	// FETCH responses aren't guaranteed to come back in UID order.
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Uid > msgs[j].Uid
+	})
+
+	return msgs, nil
+}
+
+// paginateUids returns the UIDs for the given page (0-indexed, newest
+// first) along with whether more pages are available.
+func paginateUids(uids []uint32, page int, perPage int) ([]uint32, bool) {
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] > uids[j]
+	})
+
+	start := page * perPage
+	if start >= len(uids) {
+		return nil, false
+	}
+
+	end := start + perPage
+	hasMore := end < len(uids)
+	if end > len(uids) {
+		end = len(uids)
+	}
+
+	return uids[start:end], hasMore
+}
@@ -0,0 +1,195 @@
+package koushin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+)
+
+// oauthStateCookieName holds the CSRF state plus the desired username for
+// an in-flight OAuth2 authorization-code flow, between the redirect to the
+// provider and its callback.
+const oauthStateCookieName = "koushin_oauth_state"
+
+// oauthStateMaxAge bounds how long a user has to complete the provider's
+// consent screen before the flow has to be restarted.
+const oauthStateMaxAge = 10 * time.Minute
+
+// parseOAuthProviderURL parses a provider configuration URL of the form
+//
+//	oauth2://<name>?auth_url=...&token_url=...&client_id=...&client_secret=...&scope=...&redirect_url=...
+//
+// auth_url, token_url and redirect_url are themselves URLs and must be
+// query-escaped.
+func parseOAuthProviderURL(rawURL string) (*OAuthProvider, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OAuth2 provider URL: %v", err)
+	}
+	if u.Scheme != "oauth2" {
+		return nil, fmt.Errorf("unrecognized OAuth2 provider URL scheme: %s", u.Scheme)
+	}
+
+	name := u.Host
+	if name == "" {
+		return nil, fmt.Errorf("OAuth2 provider URL is missing a name")
+	}
+
+	q := u.Query()
+	authURL := q.Get("auth_url")
+	tokenURL := q.Get("token_url")
+	clientID := q.Get("client_id")
+	if authURL == "" || tokenURL == "" || clientID == "" {
+		return nil, fmt.Errorf("OAuth2 provider %q is missing auth_url, token_url or client_id", name)
+	}
+
+	var scopes []string
+	if scope := q.Get("scope"); scope != "" {
+		scopes = strings.Fields(scope)
+	}
+
+	return &OAuthProvider{
+		Name: name,
+		Config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: q.Get("client_secret"),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  authURL,
+				TokenURL: tokenURL,
+			},
+			RedirectURL: q.Get("redirect_url"),
+			Scopes:      scopes,
+		},
+	}, nil
+}
+
+// AddOAuthProvider configures an additional login option from a provider
+// URL (see parseOAuthProviderURL), so that it shows up on the login page
+// alongside plain LOGIN/PLAIN authentication.
+func (s *Server) AddOAuthProvider(rawURL string) error {
+	provider, err := parseOAuthProviderURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if s.oauthProviders == nil {
+		s.oauthProviders = make(map[string]*OAuthProvider)
+	}
+	s.oauthProviders[provider.Name] = provider
+	return nil
+}
+
+// redirectToOAuthProvider starts the OAuth2 authorization-code flow for
+// providerName, redirecting the browser to its consent screen. The desired
+// IMAP/SMTP username and a CSRF state token are stashed in a short-lived
+// signed cookie so that the callback can recover them without a server-side
+// session.
+func (ctx *context) redirectToOAuthProvider(providerName, username string) error {
+	provider, ok := ctx.server.oauthProviders[providerName]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown OAuth2 provider")
+	}
+
+	state, err := newToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate OAuth2 state: %v", err)
+	}
+
+	ctx.SetCookie(&http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    ctx.server.signValue(state + "|" + providerName + "|" + username),
+		HttpOnly: true,
+		MaxAge:   int(oauthStateMaxAge.Seconds()),
+	})
+
+	return ctx.Redirect(http.StatusFound, provider.Config.AuthCodeURL(state))
+}
+
+// handleOAuthLogin starts the OAuth2 flow for the provider named in the
+// URL, for a plain link (as opposed to the /login form POST) such as a
+// "Log in with <provider>" button.
+func handleOAuthLogin(ectx echo.Context) error {
+	ctx := ectx.(*context)
+
+	username := ctx.QueryParam("username")
+	if username == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing username")
+	}
+
+	return ctx.redirectToOAuthProvider(ctx.Param("provider"), username)
+}
+
+// handleOAuthCallback completes the OAuth2 authorization-code flow: it
+// verifies the CSRF state, exchanges the authorization code for a token,
+// authenticates to IMAP with it, and starts a session exactly like
+// handleLogin does for a password-based login.
+func handleOAuthCallback(ectx echo.Context) error {
+	ctx := ectx.(*context)
+
+	cookie, err := ctx.Cookie(oauthStateCookieName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing OAuth2 state cookie")
+	}
+	ctx.SetCookie(&http.Cookie{
+		Name:    oauthStateCookieName,
+		Value:   "",
+		Expires: aLongTimeAgo,
+	})
+
+	value, ok := ctx.server.verifySignedValue(cookie.Value)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid OAuth2 state cookie")
+	}
+
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 {
+		return echo.NewHTTPError(http.StatusBadRequest, "malformed OAuth2 state cookie")
+	}
+	state, providerName, username := parts[0], parts[1], parts[2]
+
+	if providerName != ctx.Param("provider") {
+		return echo.NewHTTPError(http.StatusBadRequest, "OAuth2 provider mismatch")
+	}
+	if ctx.QueryParam("state") != state {
+		return echo.NewHTTPError(http.StatusBadRequest, "OAuth2 state mismatch")
+	}
+
+	provider, ok := ctx.server.oauthProviders[providerName]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown OAuth2 provider")
+	}
+
+	code := ctx.QueryParam("code")
+	if code == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing OAuth2 authorization code")
+	}
+
+	token, err := provider.Config.Exchange(ctx.Request().Context(), code)
+	if err != nil {
+		return fmt.Errorf("failed to exchange OAuth2 authorization code: %v", err)
+	}
+
+	auth := NewOAuthAuthenticator(username, provider, token)
+
+	conn, err := ctx.server.connectIMAP()
+	if err != nil {
+		return err
+	}
+	if err := auth.AuthenticateIMAP(conn); err != nil {
+		conn.Logout()
+		return ctx.Render(http.StatusOK, "login.html", nil)
+	}
+
+	sessToken, err := ctx.server.imap.pool.Put(conn, auth)
+	if err != nil {
+		return fmt.Errorf("failed to put connection in pool: %v", err)
+	}
+	ctx.setToken(sessToken)
+
+	return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
+}
@@ -0,0 +1,213 @@
+package koushin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	imapidle "github.com/emersion/go-imap-idle"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// ErrSessionExpired is returned by ConnPool.Get when the session token
+// doesn't match any pooled session.
+var ErrSessionExpired = errors.New("koushin: session expired")
+
+// idleRenewInterval is how often the IDLE command is re-issued, just under
+// the 30-minute server timeout recommended by RFC 2177.
+const idleRenewInterval = 29 * time.Minute
+
+// oauthRefreshInterval is how often OAuth2-backed sessions proactively
+// check whether their token needs refreshing.
+const oauthRefreshInterval = 5 * time.Minute
+
+// oauthRefreshLeadWindow is how far ahead of its actual expiry a token is
+// refreshed, so the background refresh has a real chance of beating it.
+const oauthRefreshLeadWindow = 10 * time.Minute
+
+// Session holds the long-lived IMAP connection and credentials associated
+// with a logged-in user, plus the machinery needed to keep it IDLE-ing in
+// the background between HTTP requests.
+type Session struct {
+	token    string
+	auth     Authenticator
+	imapConn *imapclient.Client
+
+	pool *ConnPool
+
+	idleMu   sync.Mutex
+	idleStop chan struct{}
+	idleDone chan struct{}
+
+	updates   chan imapclient.Update
+	broadcast *broadcaster
+
+	closed chan struct{}
+}
+
+// ConnPool keeps track of logged-in sessions, indexed by opaque session
+// token, and runs a background IDLE loop for each of them.
+type ConnPool struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewConnPool() *ConnPool {
+	return &ConnPool{sessions: make(map[string]*Session)}
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Put registers a freshly authenticated IMAP connection and starts its
+// background IDLE loop, returning the session token to hand back to the
+// browser as a cookie.
+func (pool *ConnPool) Put(conn *imapclient.Client, auth Authenticator) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	sess := &Session{
+		token:     token,
+		auth:      auth,
+		imapConn:  conn,
+		pool:      pool,
+		broadcast: newBroadcaster(),
+		closed:    make(chan struct{}),
+	}
+
+	updates := make(chan imapclient.Update, 64)
+	conn.Updates = updates
+	sess.updates = updates
+	go sess.consumeUpdates()
+	sess.startIdleLocked()
+
+	if oauth, ok := auth.(*OAuthAuthenticator); ok {
+		go sess.refreshOAuthLoop(oauth)
+	}
+
+	pool.mu.Lock()
+	pool.sessions[token] = sess
+	pool.mu.Unlock()
+
+	return token, nil
+}
+
+// Get returns the session for the given token, or ErrSessionExpired if
+// there's none.
+func (pool *ConnPool) Get(token string) (*Session, error) {
+	pool.mu.Lock()
+	sess, ok := pool.sessions[token]
+	pool.mu.Unlock()
+	if !ok {
+		return nil, ErrSessionExpired
+	}
+	return sess, nil
+}
+
+// Delete removes a session from the pool, e.g. on logout, stopping its
+// background IDLE loop and closing sess.closed so consumeUpdates and any
+// OAuth2 refresh loop exit too, so that neither goroutine leaks. It
+// doesn't touch conn.Updates or sess.updates: the go-imap client goroutine
+// may still be delivering a final update concurrently, and closing a
+// channel something else might still send on would panic. consumeUpdates
+// instead exits via sess.closed, leaving sess.updates to be garbage
+// collected once the client goroutine is done with it.
+func (pool *ConnPool) Delete(token string) {
+	pool.mu.Lock()
+	sess, ok := pool.sessions[token]
+	delete(pool.sessions, token)
+	pool.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	sess.idleMu.Lock()
+	if sess.idleStop != nil {
+		close(sess.idleStop)
+		<-sess.idleDone
+		sess.idleStop = nil
+		sess.idleDone = nil
+	}
+	sess.idleMu.Unlock()
+
+	close(sess.closed)
+}
+
+// refreshOAuthLoop periodically refreshes auth's token in the background,
+// so that it doesn't expire mid-request.
+func (sess *Session) refreshOAuthLoop(auth *OAuthAuthenticator) {
+	ticker := time.NewTicker(oauthRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Best-effort: a failure here just means the next IMAP/SMTP
+			// command will surface the error and force a re-login.
+			auth.refreshIfExpiringSoon(oauthRefreshLeadWindow)
+		case <-sess.closed:
+			return
+		}
+	}
+}
+
+func (sess *Session) consumeUpdates() {
+	for {
+		select {
+		case up := <-sess.updates:
+			switch up.(type) {
+			case *imapclient.MailboxUpdate, *imapclient.ExpungeUpdate, *imapclient.MessageUpdate:
+				sess.broadcast.publish()
+			}
+		case <-sess.closed:
+			return
+		}
+	}
+}
+
+func (sess *Session) startIdleLocked() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	sess.idleStop = stop
+	sess.idleDone = done
+
+	go func() {
+		defer close(done)
+		idleClient := imapidle.NewClient(sess.imapConn)
+		idleClient.LogoutTimeout = idleRenewInterval
+		// pauseIdle interrupts the command by closing stop, which ends it
+		// cleanly; any other error (e.g. a dropped connection) is ignored
+		// here and surfaces on the next synchronous command instead.
+		idleClient.IdleWithFallback(stop, idleRenewInterval)
+	}()
+}
+
+// pauseIdle interrupts the background IDLE command, if any is running, and
+// blocks until the connection is safe to use for a synchronous command.
+// It must be paired with a call to resumeIdle.
+func (sess *Session) pauseIdle() {
+	sess.idleMu.Lock()
+	if sess.idleStop != nil {
+		close(sess.idleStop)
+		<-sess.idleDone
+		sess.idleStop = nil
+		sess.idleDone = nil
+	}
+}
+
+// resumeIdle restarts the background IDLE command after a call to
+// pauseIdle.
+func (sess *Session) resumeIdle() {
+	sess.startIdleLocked()
+	sess.idleMu.Unlock()
+}
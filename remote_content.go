@@ -0,0 +1,47 @@
+package koushin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const remoteContentCookiePrefix = "koushin_remote_"
+
+// remoteContentCookieName derives a per-message cookie name from the
+// logged-in username plus the message's mailbox and UID, so that the "load
+// remote content" choice is remembered independently for each message and
+// can't bleed from one account into another on a shared browser.
+func remoteContentCookieName(username, mboxName string, uid uint32) string {
+	h := sha256.Sum256([]byte(username + "/" + mboxName + "/" + strconv.FormatUint(uint64(uid), 10)))
+	return remoteContentCookiePrefix + hex.EncodeToString(h[:8])
+}
+
+// signValue signs v with the server's secret, so that the resulting cookie
+// value can't be forged by the client.
+func (s *Server) signValue(v string) string {
+	mac := hmac.New(sha256.New, s.cookieSecret)
+	mac.Write([]byte(v))
+	return v + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedValue checks a value produced by signValue and returns the
+// original value if the signature is valid.
+func (s *Server) verifySignedValue(signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	v, sig := signed[:i], signed[i+1:]
+
+	mac := hmac.New(sha256.New, s.cookieSecret)
+	mac.Write([]byte(v))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "", false
+	}
+	return v, true
+}
@@ -0,0 +1,172 @@
+package koushin
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// HTMLPolicy is the bluemonday policy used to sanitize text/html message
+// parts before they're rendered, stripping scripts, forms and event
+// handlers. It's a package-level hook so that plugins can extend it (e.g.
+// to allow additional tags or attributes) before the server starts
+// handling requests.
+var HTMLPolicy = newDefaultHTMLPolicy()
+
+func newDefaultHTMLPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowStyling()
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+func sanitizeHTML(htmlBody string) string {
+	return HTMLPolicy.Sanitize(htmlBody)
+}
+
+var cidAttrRe = regexp.MustCompile(`(?i)(src|href)=(["'])cid:([^"']+)(["'])`)
+
+// rewriteCIDLinks rewrites "cid:" references in src/href attributes to
+// point at the corresponding inline part's raw download URL.
+func rewriteCIDLinks(htmlBody, mboxName string, uid uint32, cidPaths map[string]string) string {
+	if len(cidPaths) == 0 {
+		return htmlBody
+	}
+
+	return cidAttrRe.ReplaceAllStringFunc(htmlBody, func(match string) string {
+		sub := cidAttrRe.FindStringSubmatch(match)
+		attr, quote, cid := sub[1], sub[2], sub[3]
+
+		partPath, ok := cidPaths[cid]
+		if !ok {
+			return match
+		}
+
+		url := fmt.Sprintf("/message/%s/%d/raw?part=%s", url.PathEscape(mboxName), uid, partPath)
+		return fmt.Sprintf("%s=%s%s%s", attr, quote, url, quote)
+	})
+}
+
+// cidPartPaths walks a message's body structure and returns a map from the
+// Content-ID of each part (stripped of angle brackets) to its part path,
+// e.g. "1.2".
+func cidPartPaths(bs *imap.BodyStructure) map[string]string {
+	paths := make(map[string]string)
+	if bs == nil {
+		return paths
+	}
+
+	var walk func(bs *imap.BodyStructure, prefix []int)
+	walk = func(bs *imap.BodyStructure, prefix []int) {
+		if bs.Id != "" {
+			paths[strings.Trim(bs.Id, "<>")] = formatPartPath(prefix)
+		}
+		for i, part := range bs.Parts {
+			walk(part, append(append([]int{}, prefix...), i+1))
+		}
+	}
+	walk(bs, nil)
+
+	return paths
+}
+
+func formatPartPath(path []int) string {
+	strs := make([]string, len(path))
+	for i, p := range path {
+		strs[i] = strconv.Itoa(p)
+	}
+	return strings.Join(strs, ".")
+}
+
+var remoteURLAttrRe = regexp.MustCompile(`(?i)(src|href)=(["'])((?:https?:)?//[^"']+)(["'])`)
+var remoteURLInStyleRe = regexp.MustCompile(`(?i)url\(\s*["']?((?:https?:)?//[^)"']+)["']?\s*\)`)
+
+// blockRemoteContent replaces external image/stylesheet/url() targets with
+// a placeholder, so that loading a message can't be used to track the
+// user. The original URL is kept around — in a data attribute for
+// src/href, in a CSS comment for url() — so that the "load remote
+// content" toggle can restore it.
+func blockRemoteContent(htmlBody string) string {
+	htmlBody = remoteURLAttrRe.ReplaceAllString(htmlBody, `$1=$2$4 data-koushin-remote-src=$2$3$4`)
+	htmlBody = remoteURLInStyleRe.ReplaceAllString(htmlBody, `url() /*koushin-remote-src:$1*/`)
+	return htmlBody
+}
+
+// pickPreferredTextPart walks bs looking for the best part to display by
+// default: the HTML alternative when present, falling back to plain text.
+// It returns nil if bs isn't a multipart message, in which case the
+// top-level part is used as before.
+func pickPreferredTextPart(bs *imap.BodyStructure) []int {
+	if bs == nil || !strings.EqualFold(bs.MIMEType, "multipart") {
+		return nil
+	}
+
+	if strings.EqualFold(bs.MIMESubType, "alternative") {
+		return pickAlternative(bs.Parts, nil)
+	}
+
+	// multipart/mixed and friends: the first body part usually carries the
+	// message text, the rest are attachments.
+	for i, part := range bs.Parts {
+		if strings.EqualFold(part.MIMEType, "multipart") && strings.EqualFold(part.MIMESubType, "alternative") {
+			return pickAlternative(part.Parts, []int{i + 1})
+		}
+		if strings.EqualFold(part.MIMEType, "text") {
+			return []int{i + 1}
+		}
+	}
+
+	return nil
+}
+
+func pickAlternative(parts []*imap.BodyStructure, prefix []int) []int {
+	var htmlPath []int
+	fallback := -1
+	for i, part := range parts {
+		if strings.EqualFold(part.MIMEType, "text") {
+			if strings.EqualFold(part.MIMESubType, "html") {
+				htmlPath = append(append([]int{}, prefix...), i+1)
+				break
+			}
+			if fallback == -1 {
+				fallback = i
+			}
+			continue
+		}
+
+		// Some clients (e.g. Outlook, or Gmail with inline images) wrap
+		// the HTML alternative together with its inline images in a
+		// multipart/related part instead of listing it directly.
+		if strings.EqualFold(part.MIMEType, "multipart") && strings.EqualFold(part.MIMESubType, "related") {
+			if path := relatedHTMLPart(part.Parts, append(append([]int{}, prefix...), i+1)); path != nil {
+				htmlPath = path
+				break
+			}
+		}
+	}
+
+	if htmlPath != nil {
+		return htmlPath
+	}
+	if fallback == -1 {
+		return nil
+	}
+	return append(append([]int{}, prefix...), fallback+1)
+}
+
+// relatedHTMLPart returns the path to the text/html part among a
+// multipart/related part's children, if any.
+func relatedHTMLPart(parts []*imap.BodyStructure, prefix []int) []int {
+	for i, part := range parts {
+		if strings.EqualFold(part.MIMEType, "text") && strings.EqualFold(part.MIMESubType, "html") {
+			return append(append([]int{}, prefix...), i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package koushin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const searchDateLayout = "2006-01-02"
+
+// parseSearchQuery translates a simple query DSL into IMAP search criteria.
+// Recognized filters are "from:", "to:", "subject:", "since:", "before:"
+// and "has:attachment"; any other term is matched against the whole
+// message via IMAP TEXT.
+func parseSearchQuery(query string) (*imap.SearchCriteria, error) {
+	criteria := imap.NewSearchCriteria()
+
+	for _, term := range strings.Fields(query) {
+		key, value, hasFilter := cutSearchTerm(term)
+		if !hasFilter {
+			criteria.Text = append(criteria.Text, term)
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "from":
+			criteria.Header.Add("From", value)
+		case "to":
+			criteria.Header.Add("To", value)
+		case "subject":
+			criteria.Header.Add("Subject", value)
+		case "since":
+			t, err := time.Parse(searchDateLayout, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid since: date %q: %v", value, err)
+			}
+			criteria.Since = t
+		case "before":
+			t, err := time.Parse(searchDateLayout, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid before: date %q: %v", value, err)
+			}
+			criteria.Before = t
+		case "has":
+			if strings.EqualFold(value, "attachment") {
+				// IMAP SEARCH's HEADER criterion only ever looks at the
+				// top-level message header, never at MIME sub-part
+				// headers, so there's no way to faithfully ask the server
+				// "does this message have an attachment part". Matching
+				// the top-level Content-Disposition against "attachment"
+				// catches messages sent as a single attachment part, and
+				// Content-Type against "multipart/mixed" catches the
+				// common case of a mixed message carrying one; messages
+				// that nest their attachment inside multipart/related or
+				// multipart/alternative wrappers won't match.
+				criteria.Or = append(criteria.Or, [2]*imap.SearchCriteria{
+					headerCriteria("Content-Disposition", "attachment"),
+					headerCriteria("Content-Type", "multipart/mixed"),
+				})
+			} else {
+				// Unrecognized has: value: keep it as a plain text term
+				// rather than silently dropping it.
+				criteria.Text = append(criteria.Text, term)
+			}
+		default:
+			// Unknown filters are kept as plain text terms.
+			criteria.Text = append(criteria.Text, term)
+		}
+	}
+
+	return criteria, nil
+}
+
+// headerCriteria returns a search criterion matching messages whose key
+// header contains value.
+func headerCriteria(key, value string) *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	c.Header.Add(key, value)
+	return c
+}
+
+// cutSearchTerm splits a "key:value" search term at its first colon. ok is
+// false when term doesn't contain a colon; the key isn't checked against
+// the recognized filters.
+func cutSearchTerm(term string) (key, value string, ok bool) {
+	i := strings.IndexByte(term, ':')
+	if i < 0 {
+		return "", term, false
+	}
+	return term[:i], term[i+1:], true
+}
+
+// parseSearchPage parses the "page" query parameter, defaulting to 0.
+func parseSearchPage(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	page, err := strconv.Atoi(s)
+	if err != nil || page < 0 {
+		return 0, fmt.Errorf("invalid page %q", s)
+	}
+	return page, nil
+}
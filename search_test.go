@@ -0,0 +1,136 @@
+package koushin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCutSearchTerm(t *testing.T) {
+	tests := []struct {
+		term      string
+		wantKey   string
+		wantValue string
+		wantOk    bool
+	}{
+		{"from:alice@example.com", "from", "alice@example.com", true},
+		{"subject:re:hi", "subject", "re:hi", true},
+		{"hello", "", "hello", false},
+		{"", "", "", false},
+	}
+
+	for _, tc := range tests {
+		key, value, ok := cutSearchTerm(tc.term)
+		if key != tc.wantKey || value != tc.wantValue || ok != tc.wantOk {
+			t.Errorf("cutSearchTerm(%q) = (%q, %q, %v), want (%q, %q, %v)",
+				tc.term, key, value, ok, tc.wantKey, tc.wantValue, tc.wantOk)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	criteria, err := parseSearchQuery("from:alice subject:hello invoice")
+	if err != nil {
+		t.Fatalf("parseSearchQuery() error = %v", err)
+	}
+	if got := criteria.Header.Get("From"); got != "alice" {
+		t.Errorf("From header = %q, want %q", got, "alice")
+	}
+	if got := criteria.Header.Get("Subject"); got != "hello" {
+		t.Errorf("Subject header = %q, want %q", got, "hello")
+	}
+	if len(criteria.Text) != 1 || criteria.Text[0] != "invoice" {
+		t.Errorf("Text = %v, want [invoice]", criteria.Text)
+	}
+}
+
+func TestParseSearchQueryDates(t *testing.T) {
+	criteria, err := parseSearchQuery("since:2024-01-01 before:2024-02-01")
+	if err != nil {
+		t.Fatalf("parseSearchQuery() error = %v", err)
+	}
+	if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !criteria.Since.Equal(want) {
+		t.Errorf("Since = %v, want %v", criteria.Since, want)
+	}
+	if want := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC); !criteria.Before.Equal(want) {
+		t.Errorf("Before = %v, want %v", criteria.Before, want)
+	}
+}
+
+func TestParseSearchQueryInvalidDate(t *testing.T) {
+	if _, err := parseSearchQuery("since:not-a-date"); err == nil {
+		t.Fatal("parseSearchQuery() with an invalid since: date should error")
+	}
+}
+
+func TestParseSearchQueryHasAttachment(t *testing.T) {
+	criteria, err := parseSearchQuery("has:attachment")
+	if err != nil {
+		t.Fatalf("parseSearchQuery() error = %v", err)
+	}
+	if len(criteria.Or) != 1 {
+		t.Fatalf("Or = %v, want exactly one alternative", criteria.Or)
+	}
+}
+
+func TestParseSearchQueryHasUnrecognizedValue(t *testing.T) {
+	criteria, err := parseSearchQuery("has:foo")
+	if err != nil {
+		t.Fatalf("parseSearchQuery() error = %v", err)
+	}
+	if len(criteria.Or) != 0 {
+		t.Errorf("Or = %v, want none for an unrecognized has: value", criteria.Or)
+	}
+	if len(criteria.Text) != 1 || criteria.Text[0] != "has:foo" {
+		t.Errorf("Text = %v, want [has:foo] so the term isn't silently dropped", criteria.Text)
+	}
+}
+
+func TestParseSearchPage(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"3", 3, false},
+		{"-1", 0, true},
+		{"nope", 0, true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseSearchPage(tc.s)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseSearchPage(%q) error = %v, wantErr %v", tc.s, err, tc.wantErr)
+			continue
+		}
+		if err == nil && got != tc.want {
+			t.Errorf("parseSearchPage(%q) = %d, want %d", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestPaginateUids(t *testing.T) {
+	uids := []uint32{1, 2, 3, 4, 5}
+
+	page, hasMore := paginateUids(append([]uint32{}, uids...), 0, 2)
+	if hasMore != true {
+		t.Errorf("hasMore = %v, want true", hasMore)
+	}
+	if got := page; len(got) != 2 || got[0] != 5 || got[1] != 4 {
+		t.Errorf("page 0 = %v, want [5 4]", got)
+	}
+
+	page, hasMore = paginateUids(append([]uint32{}, uids...), 2, 2)
+	if hasMore != false {
+		t.Errorf("hasMore = %v, want false", hasMore)
+	}
+	if len(page) != 1 || page[0] != 1 {
+		t.Errorf("page 2 = %v, want [1]", page)
+	}
+
+	page, hasMore = paginateUids(append([]uint32{}, uids...), 10, 2)
+	if page != nil || hasMore != false {
+		t.Errorf("page past the end = (%v, %v), want (nil, false)", page, hasMore)
+	}
+}
@@ -1,21 +1,27 @@
 package koushin
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-imap"
 	imapclient "github.com/emersion/go-imap/client"
-	"github.com/emersion/go-sasl"
 	"github.com/labstack/echo/v4"
 )
 
 const cookieName = "koushin_session"
 
+// remoteContentCookieMaxAge is how long a "load remote content" choice is
+// remembered for a given message.
+const remoteContentCookieMaxAge = 30 * 24 * time.Hour
+
 type Server struct {
 	imap struct {
 		host     string
@@ -30,6 +36,18 @@ type Server struct {
 		tls      bool
 		insecure bool
 	}
+
+	// SentMailboxFallback is used as the Sent mailbox name when the IMAP
+	// server doesn't advertise a \Sent SPECIAL-USE mailbox.
+	SentMailboxFallback string
+
+	// cookieSecret signs the "load remote content" cookies so that they
+	// can't be forged by the client.
+	cookieSecret []byte
+
+	// oauthProviders holds the OAuth2 providers available on the login
+	// page, indexed by name, as configured via AddOAuthProvider.
+	oauthProviders map[string]*OAuthProvider
 }
 
 func (s *Server) parseIMAPURL(imapURL string) error {
@@ -81,6 +99,12 @@ func NewServer(imapURL, smtpURL string) (*Server, error) {
 		return nil, err
 	}
 	s.imap.pool = NewConnPool()
+	s.SentMailboxFallback = defaultSentMailboxName
+
+	s.cookieSecret = make([]byte, 32)
+	if _, err := rand.Read(s.cookieSecret); err != nil {
+		return nil, fmt.Errorf("failed to generate cookie secret: %v", err)
+	}
 
 	if smtpURL != "" {
 		if err := s.parseSMTPURL(smtpURL); err != nil {
@@ -113,9 +137,28 @@ func (c *context) setToken(token string) {
 	c.SetCookie(&cookie)
 }
 
+// remoteContentAllowed reports whether the user has opted into loading
+// remote content for the given message, via its signed cookie.
+func (ctx *context) remoteContentAllowed(mboxName string, uid uint32) bool {
+	cookie, err := ctx.Cookie(remoteContentCookieName(ctx.session.auth.Username(), mboxName, uid))
+	if err != nil {
+		return false
+	}
+	v, ok := ctx.server.verifySignedValue(cookie.Value)
+	return ok && v == "1"
+}
+
 func handleLogin(ectx echo.Context) error {
 	ctx := ectx.(*context)
 	username := ctx.FormValue("username")
+
+	if provider := ctx.FormValue("provider"); provider != "" {
+		if username == "" {
+			return ctx.Render(http.StatusOK, "login.html", nil)
+		}
+		return ctx.redirectToOAuthProvider(provider, username)
+	}
+
 	password := ctx.FormValue("password")
 	if username != "" && password != "" {
 		conn, err := ctx.server.connectIMAP()
@@ -123,12 +166,13 @@ func handleLogin(ectx echo.Context) error {
 			return err
 		}
 
-		if err := conn.Login(username, password); err != nil {
+		auth := NewLoginAuthenticator(username, password)
+		if err := auth.AuthenticateIMAP(conn); err != nil {
 			conn.Logout()
 			return ctx.Render(http.StatusOK, "login.html", nil)
 		}
 
-		token, err := ctx.server.imap.pool.Put(conn, username, password)
+		token, err := ctx.server.imap.pool.Put(conn, auth)
 		if err != nil {
 			return fmt.Errorf("failed to put connection in pool: %v", err)
 		}
@@ -137,7 +181,9 @@ func handleLogin(ectx echo.Context) error {
 		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 	}
 
-	return ctx.Render(http.StatusOK, "login.html", nil)
+	return ctx.Render(http.StatusOK, "login.html", map[string]interface{}{
+		"OAuthProviders": ctx.server.oauthProviders,
+	})
 }
 
 func handleGetPart(ctx *context, raw bool) error {
@@ -157,6 +203,19 @@ func handleGetPart(ctx *context, raw bool) error {
 		return err
 	}
 
+	// When no part was explicitly requested, prefer the HTML alternative
+	// of a multipart/alternative message over showing its raw container.
+	if !raw && partPathString == "" {
+		if preferred := pickPreferredTextPart(msg.BodyStructure); preferred != nil {
+			partPath = preferred
+			partPathString = formatPartPath(preferred)
+			msg, part, err = getMessagePart(ctx.conn, mboxName, uid, partPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	mimeType, _, err := part.Header.ContentType()
 	if err != nil {
 		return fmt.Errorf("failed to parse part Content-Type: %v", err)
@@ -183,7 +242,26 @@ func handleGetPart(ctx *context, raw bool) error {
 	}
 
 	var body string
-	if strings.HasPrefix(strings.ToLower(mimeType), "text/") {
+	var htmlBody bool
+	remoteContentAllowed := ctx.remoteContentAllowed(mboxName, uid)
+	switch {
+	case strings.EqualFold(mimeType, "text/html"):
+		b, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read part body: %v", err)
+		}
+
+		// cid: URLs are rewritten before sanitizing, since the sanitizer
+		// drops URLs with schemes it doesn't allow.
+		html := rewriteCIDLinks(string(b), mboxName, uid, cidPartPaths(msg.BodyStructure))
+		html = sanitizeHTML(html)
+		if !remoteContentAllowed {
+			html = blockRemoteContent(html)
+		}
+
+		body = html
+		htmlBody = true
+	case strings.HasPrefix(strings.ToLower(mimeType), "text/"):
 		b, err := ioutil.ReadAll(part.Body)
 		if err != nil {
 			return fmt.Errorf("failed to read part body: %v", err)
@@ -192,22 +270,72 @@ func handleGetPart(ctx *context, raw bool) error {
 	}
 
 	return ctx.Render(http.StatusOK, "message.html", map[string]interface{}{
-		"Mailbox":  ctx.conn.Mailbox(),
-		"Message":  msg,
-		"Body":     body,
-		"PartPath": partPathString,
+		"Mailbox":              ctx.conn.Mailbox(),
+		"Message":              msg,
+		"Body":                 body,
+		"HTMLBody":             htmlBody,
+		"PartPath":             partPathString,
+		"RemoteContentAllowed": remoteContentAllowed,
+	})
+}
+
+// handleLoadRemoteContent records the user's choice to load remote content
+// (external images, stylesheets, etc.) for a single message, in a signed
+// cookie scoped to that message.
+func handleLoadRemoteContent(ectx echo.Context) error {
+	ctx := ectx.(*context)
+	mboxName := ctx.Param("mbox")
+	uid, err := parseUid(ctx.Param("uid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	ctx.SetCookie(&http.Cookie{
+		Name:     remoteContentCookieName(ctx.session.auth.Username(), mboxName, uid),
+		Value:    ctx.server.signValue("1"),
+		HttpOnly: true,
+		MaxAge:   int(remoteContentCookieMaxAge.Seconds()),
 	})
+
+	return ctx.Redirect(http.StatusFound, fmt.Sprintf("/message/%s/%d", url.PathEscape(mboxName), uid))
+}
+
+// splitAddressField splits a comma-separated form field into a list of
+// addresses, skipping empty entries (e.g. when the field is blank).
+func splitAddressField(s string) []string {
+	var l []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			l = append(l, addr)
+		}
+	}
+	return l
 }
 
 func handleCompose(ectx echo.Context) error {
 	ctx := ectx.(*context)
 
 	if ctx.Request().Method == http.MethodPost {
-		// TODO: parse address lists
-		from := ctx.FormValue("from")
-		to := ctx.FormValue("to")
-		subject := ctx.FormValue("subject")
-		text := ctx.FormValue("text")
+		if err := ctx.Request().ParseMultipartForm(32 << 20); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		var attachments []*multipart.FileHeader
+		if ctx.Request().MultipartForm != nil {
+			attachments = ctx.Request().MultipartForm.File["attachments"]
+		}
+
+		msg := OutgoingMessage{
+			From:        ctx.FormValue("from"),
+			To:          splitAddressField(ctx.FormValue("to")),
+			Cc:          splitAddressField(ctx.FormValue("cc")),
+			Bcc:         splitAddressField(ctx.FormValue("bcc")),
+			Subject:     ctx.FormValue("subject"),
+			Text:        ctx.FormValue("text"),
+			InReplyTo:   ctx.FormValue("in-reply-to"),
+			References:  strings.Fields(ctx.FormValue("references")),
+			Attachments: attachments,
+		}
 
 		c, err := ctx.server.connectSMTP()
 		if err != nil {
@@ -215,18 +343,16 @@ func handleCompose(ectx echo.Context) error {
 		}
 		defer c.Close()
 
-		auth := sasl.NewPlainClient("", ctx.session.username, ctx.session.password)
+		auth, err := ctx.session.auth.SMTPClient()
+		if err != nil {
+			return err
+		}
 		if err := c.Auth(auth); err != nil {
 			return echo.NewHTTPError(http.StatusForbidden, err)
 		}
 
-		msg := OutgoingMessage{
-			from: from,
-			to: []string{to},
-			subject: subject,
-			text: text,
-		}
-		if err := sendMessage(c, &msg); err != nil {
+		raw, err := sendMessage(c, &msg)
+		if err != nil {
 			return err
 		}
 
@@ -234,7 +360,13 @@ func handleCompose(ectx echo.Context) error {
 			return fmt.Errorf("QUIT failed: %v", err)
 		}
 
-		// TODO: append to IMAP Sent mailbox
+		sentMailbox, err := findSentMailbox(ctx.conn, ctx.server.SentMailboxFallback)
+		if err != nil {
+			return err
+		}
+		if err := appendToSent(ctx.conn, sentMailbox, raw); err != nil {
+			return fmt.Errorf("failed to append message to %q: %v", sentMailbox, err)
+		}
 
 		return ctx.Redirect(http.StatusFound, "/mailbox/INBOX")
 	}
@@ -267,8 +399,9 @@ func New(imapURL, smtpURL string) *echo.Echo {
 
 			cookie, err := ctx.Cookie(cookieName)
 			if err == http.ErrNoCookie {
-				// Require auth for all pages except /login
-				if ctx.Path() == "/login" {
+				// Require auth for all pages except /login and the OAuth2
+				// login/callback routes, which establish that auth.
+				if strings.HasPrefix(ctx.Path(), "/login") {
 					return next(ctx)
 				} else {
 					return ctx.Redirect(http.StatusFound, "/login")
@@ -286,6 +419,19 @@ func New(imapURL, smtpURL string) *echo.Echo {
 			}
 			ctx.conn = ctx.session.imapConn
 
+			// The /events endpoint holds the connection open to stream
+			// updates; it must not pause the background IDLE loop that
+			// feeds it. /logout tears down the session (and its IDLE
+			// loop) itself via pool.Delete, which already locks idleMu to
+			// stop it; pausing it here too would deadlock re-locking the
+			// same non-reentrant mutex in the handler.
+			if ctx.Path() == "/events" || ctx.Path() == "/logout" {
+				return next(ctx)
+			}
+
+			ctx.session.pauseIdle()
+			defer ctx.session.resumeIdle()
+
 			return next(ctx)
 		}
 	})
@@ -303,7 +449,7 @@ func New(imapURL, smtpURL string) *echo.Echo {
 			return err
 		}
 
-		msgs, err := listMessages(ctx.conn, ctx.Param("mbox"))
+		msgs, err := listMessages(ctx.conn, ctx.Param("mbox"), nil)
 		if err != nil {
 			return err
 		}
@@ -315,6 +461,59 @@ func New(imapURL, smtpURL string) *echo.Echo {
 		})
 	})
 
+	e.GET("/mailbox/:mbox/search", func(ectx echo.Context) error {
+		ctx := ectx.(*context)
+
+		mailboxes, err := listMailboxes(ctx.conn)
+		if err != nil {
+			return err
+		}
+
+		query := ctx.QueryParam("q")
+		criteria, err := parseSearchQuery(query)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		mboxName := ctx.Param("mbox")
+		if _, err := ctx.conn.Select(mboxName, false); err != nil {
+			return fmt.Errorf("failed to select mailbox: %v", err)
+		}
+
+		uids, err := ctx.conn.UidSearch(criteria)
+		if err != nil {
+			return fmt.Errorf("UID SEARCH failed: %v", err)
+		}
+
+		page, err := parseSearchPage(ctx.QueryParam("page"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		pageUids, hasMore := paginateUids(uids, page, messagesPerPage)
+
+		var msgs []*imap.Message
+		if len(pageUids) > 0 {
+			set := new(imap.SeqSet)
+			for _, uid := range pageUids {
+				set.AddNum(uid)
+			}
+
+			msgs, err = listMessages(ctx.conn, mboxName, set)
+			if err != nil {
+				return err
+			}
+		}
+
+		return ctx.Render(http.StatusOK, "mailbox.html", map[string]interface{}{
+			"Mailbox":   ctx.conn.Mailbox(),
+			"Mailboxes": mailboxes,
+			"Messages":  msgs,
+			"Query":     query,
+			"Page":      page,
+			"HasMore":   hasMore,
+		})
+	})
+
 	e.GET("/message/:mbox/:uid", func(ectx echo.Context) error {
 		ctx := ectx.(*context)
 		return handleGetPart(ctx, false)
@@ -323,12 +522,19 @@ func New(imapURL, smtpURL string) *echo.Echo {
 		ctx := ectx.(*context)
 		return handleGetPart(ctx, true)
 	})
+	e.POST("/message/:mbox/:uid/remote-content", handleLoadRemoteContent)
 
 	e.GET("/login", handleLogin)
 	e.POST("/login", handleLogin)
+	e.GET("/login/oauth/:provider", handleOAuthLogin)
+	e.GET("/login/oauth/:provider/callback", handleOAuthCallback)
 
 	e.GET("/logout", func(ectx echo.Context) error {
 		ctx := ectx.(*context)
+		// Stop the background IDLE loop and drop the session from the
+		// pool before issuing LOGOUT, so the IDLE command isn't still
+		// in flight on the wire when we do.
+		ctx.server.imap.pool.Delete(ctx.session.token)
 		if err := ctx.conn.Logout(); err != nil {
 			return fmt.Errorf("failed to logout: %v", err)
 		}
@@ -339,6 +545,8 @@ func New(imapURL, smtpURL string) *echo.Echo {
 	e.GET("/compose", handleCompose)
 	e.POST("/compose", handleCompose)
 
+	e.GET("/events", handleEvents)
+
 	e.Static("/assets", "public/assets")
 
 	return e